@@ -5,10 +5,13 @@ package binary
 
 import (
 	"context"
+	"errors"
 	"sync"
 
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql/parser"
+	"golang.org/x/sync/errgroup"
+
 	"github.com/thanos-community/promql-engine/physicalplan/model"
 )
 
@@ -16,16 +19,29 @@ import (
 type vectorOperator struct {
 	pool *model.VectorPool
 	once sync.Once
+	// tableOnce guards the lazy construction of table and outputCache, which
+	// is deferred until Next observes that both lhs and rhs produced a
+	// non-empty step batch, so that a query pruned by an empty side never
+	// pays the join cost.
+	tableOnce sync.Once
 
 	lhs       model.VectorOperator
 	rhs       model.VectorOperator
 	matching  *parser.VectorMatching
 	operation parser.ItemType
+	// returnBool is set when the binary expression carries the `bool` modifier.
+	// It only has meaning for comparison operators: instead of filtering out
+	// pairs which do not satisfy the comparison, every joined pair is emitted
+	// as 0 or 1.
+	returnBool bool
 
 	// series contains the output series of the operator
 	series []labels.Labels
 	// The outputCache is an internal cache used to calculate
-	// the binary operation of the lhs and rhs operator.
+	// the binary operation of the lhs and rhs operator. Filter-vs-bool
+	// comparison semantics (whether a step drops or zero/one-fills a
+	// non-matching pair) are implemented by table, which lives outside
+	// this chunk.
 	outputCache []sample
 	// highCardOutputIndex is a mapping from series ID of the high cardinality
 	// operator to an output series ID.
@@ -40,6 +56,17 @@ type vectorOperator struct {
 	// table is used to calculate the binary operation of two step vectors between
 	// the lhs and rhs operator.
 	table *table
+
+	// lhsSigs and rhsSigs map an input series ID from the lhs/rhs operator to its
+	// vector matching signature. They are only populated for set operators
+	// (and/or/unless), which match series without joining their samples.
+	lhsSigs []uint64
+	rhsSigs []uint64
+	// rhsOutputIndex maps a rhs series ID to an output series ID for the `or`
+	// operator. Every rhs series gets an output slot, since whether it
+	// contributes a sample at a given step is a per-step decision made in
+	// execSetOperation, not something that can be ruled out ahead of time.
+	rhsOutputIndex []uint64
 }
 
 func NewVectorOperator(
@@ -48,13 +75,15 @@ func NewVectorOperator(
 	rhs model.VectorOperator,
 	matching *parser.VectorMatching,
 	operation parser.ItemType,
+	returnBool bool,
 ) (model.VectorOperator, error) {
 	return &vectorOperator{
-		pool:      pool,
-		lhs:       lhs,
-		rhs:       rhs,
-		matching:  matching,
-		operation: operation,
+		pool:       pool,
+		lhs:        lhs,
+		rhs:        rhs,
+		matching:   matching,
+		operation:  operation,
+		returnBool: returnBool,
 	}, nil
 }
 
@@ -69,15 +98,27 @@ func (o *vectorOperator) Series(ctx context.Context) ([]labels.Labels, error) {
 }
 
 func (o *vectorOperator) initOutputs(ctx context.Context) error {
-	// TODO(fpetkovski): execute in parallel
-	highCardSide, err := o.lhs.Series(ctx)
-	if err != nil {
-		return err
+	if isSetOperation(o.operation) {
+		return o.initSetOutputs(ctx)
 	}
-	lowCardSide, err := o.rhs.Series(ctx)
-	if err != nil {
+
+	var lhsSeries, rhsSeries []labels.Labels
+	g, gctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		var err error
+		lhsSeries, err = o.lhs.Series(gctx)
+		return err
+	})
+	g.Go(func() error {
+		var err error
+		rhsSeries, err = o.rhs.Series(gctx)
+		return err
+	})
+	if err := g.Wait(); err != nil {
 		return err
 	}
+
+	highCardSide, lowCardSide := lhsSeries, rhsSeries
 	if o.matching.Card == parser.CardOneToMany {
 		highCardSide, lowCardSide = lowCardSide, highCardSide
 	}
@@ -85,7 +126,10 @@ func (o *vectorOperator) initOutputs(ctx context.Context) error {
 	buf := make([]byte, 128)
 	highCardHashes, highCardInputMap := o.hashSeries(highCardSide, true, buf)
 	lowCardHashes, lowCardInputMap := o.hashSeries(lowCardSide, false, buf)
-	output, highCardOutputIndex, lowCardOutputIndex := o.join(highCardHashes, highCardInputMap, lowCardHashes, lowCardInputMap)
+	output, highCardOutputIndex, lowCardOutputIndex, err := o.join(highCardHashes, highCardInputMap, lowCardHashes, lowCardInputMap, lowCardSide)
+	if err != nil {
+		return err
+	}
 
 	series := make([]labels.Labels, len(output))
 	for _, s := range output {
@@ -94,18 +138,30 @@ func (o *vectorOperator) initOutputs(ctx context.Context) error {
 	o.series = series
 	o.highCardOutputIndex = highCardOutputIndex
 	o.lowCardOutputIndex = lowCardOutputIndex
-	o.outputCache = make([]sample, len(series))
 	o.pool.SetStepSize(len(highCardSide))
 
-	t, err := newTable(o.pool, o.matching.Card, o.operation, o.outputCache, highCardOutputIndex, lowCardOutputIndex)
-	if err != nil {
-		return err
-	}
-	o.table = t
-
 	return nil
 }
 
+// ensureTable lazily builds the outputCache and table used to evaluate the
+// arithmetic/comparison operation. It is only called once Next has observed
+// that both lhs and rhs produced a non-empty step batch, so a query which
+// gets pruned by an empty side never pays the join cost.
+func (o *vectorOperator) ensureTable() error {
+	var err error
+	o.tableOnce.Do(func() {
+		o.outputCache = make([]sample, len(o.series))
+
+		var t *table
+		t, err = newTable(o.pool, o.matching.Card, o.operation, o.returnBool, o.outputCache, o.highCardOutputIndex, o.lowCardOutputIndex)
+		if err != nil {
+			return
+		}
+		o.table = t
+	})
+	return err
+}
+
 func (o *vectorOperator) Next(ctx context.Context) ([]model.StepVector, error) {
 	lhs, err := o.lhs.Next(ctx)
 	if err != nil {
@@ -116,10 +172,7 @@ func (o *vectorOperator) Next(ctx context.Context) ([]model.StepVector, error) {
 		return nil, err
 	}
 
-	// TODO(fpetkovski): When one operator becomes empty,
-	// we might want to drain or close the other one.
-	// We don't have a concept of closing an operator yet.
-	if len(lhs) == 0 || len(rhs) == 0 {
+	if len(lhs) == 0 && len(rhs) == 0 {
 		return nil, nil
 	}
 
@@ -128,6 +181,45 @@ func (o *vectorOperator) Next(ctx context.Context) ([]model.StepVector, error) {
 		return nil, err
 	}
 
+	if isSetOperation(o.operation) {
+		// `or` keeps emitting from whichever side still has data, even
+		// after the other one is exhausted, so it must see an exhausted
+		// side's empty batch rather than short-circuit on it.
+		if o.operation == parser.LOR {
+			return o.execSetOperation(lhs, rhs), nil
+		}
+		// `and`/`unless` only ever emit lhs samples: once lhs is exhausted,
+		// no further output is possible and rhs can be closed to release any
+		// resources it still holds.
+		if len(lhs) == 0 {
+			o.rhs.GetPool().PutVectors(rhs)
+			return nil, o.rhs.Close(ctx)
+		}
+		// Once rhs is exhausted, `and` has nothing left to match and lhs can
+		// be closed, while `unless` keeps emitting every remaining lhs sample.
+		if len(rhs) == 0 && o.operation == parser.LAND {
+			o.lhs.GetPool().PutVectors(lhs)
+			return nil, o.lhs.Close(ctx)
+		}
+		return o.execSetOperation(lhs, rhs), nil
+	}
+
+	// Arithmetic/comparison operators join samples from both sides: once
+	// either is exhausted, release the other and close it to release any
+	// buffered chunks, storage iterators or goroutines it holds.
+	if len(lhs) == 0 {
+		o.rhs.GetPool().PutVectors(rhs)
+		return nil, o.rhs.Close(ctx)
+	}
+	if len(rhs) == 0 {
+		o.lhs.GetPool().PutVectors(lhs)
+		return nil, o.lhs.Close(ctx)
+	}
+
+	if err := o.ensureTable(); err != nil {
+		return nil, err
+	}
+
 	batch := o.pool.GetVectorBatch()
 	for i, vector := range lhs {
 		step := o.table.execBinaryOperation(lhs[i], rhs[i])
@@ -147,6 +239,15 @@ func (o *vectorOperator) GetPool() *model.VectorPool {
 	return o.pool
 }
 
+// Close releases both the lhs and rhs operators. It is safe to call more
+// than once and after the operator has already been drained by Next.
+func (o *vectorOperator) Close(ctx context.Context) error {
+	if err := o.lhs.Close(ctx); err != nil {
+		return err
+	}
+	return o.rhs.Close(ctx)
+}
+
 // hashSeries calculates the hash of each series from an input operator.
 // Since series from the high cardinality operator can map to multiple output series,
 // hashSeries returns an index from hash to a slice of resulting series, and
@@ -179,12 +280,17 @@ func (o *vectorOperator) hashSeries(series []labels.Labels, keepLabels bool, buf
 // The high cardinality operator can fail to join, which is why its index contains nullable values.
 // The low cardinality operator can join to multiple high cardinality series, which is why its index
 // points to an array of output series.
+// When matching.Include is set (group_left/group_right), the listed labels are copied from the
+// matching low cardinality series onto each output series, overwriting any conflicting label from
+// the high cardinality side. A high cardinality series matching more than one low cardinality
+// series is an error, since the match would otherwise be ambiguous.
 func (o *vectorOperator) join(
 	highCardHashes map[uint64][]model.Series,
 	highCardInputIndex map[uint64][]uint64,
 	lowCardHashes map[uint64][]model.Series,
 	lowCardInputIndex map[uint64][]uint64,
-) ([]model.Series, []*uint64, [][]uint64) {
+	lowCardSide []labels.Labels,
+) ([]model.Series, []*uint64, [][]uint64, error) {
 	// Output index points from output series ID
 	// to the actual series.
 	outputIndex := make([]model.Series, 0)
@@ -203,12 +309,25 @@ func (o *vectorOperator) join(
 	highCardOutputIndex := make([]*uint64, outputSize)
 	lowCardOutputIndex := make([][]uint64, outputSize)
 	for hash, outputSeries := range highCardHashes {
-		lowCardSeriesID := lowCardInputIndex[hash][0]
+		lowCardIDs := lowCardInputIndex[hash]
+		if len(lowCardIDs) > 1 {
+			switch o.matching.Card {
+			case parser.CardOneToOne:
+				return nil, nil, nil, errors.New("multiple matches for labels: many-to-one matching must be explicit")
+			case parser.CardManyToOne, parser.CardOneToMany:
+				return nil, nil, nil, errors.New("multiple matches for labels: grouping labels must ensure unique matches")
+			}
+		}
+		lowCardSeriesID := lowCardIDs[0]
 		// Each low cardinality series can map to multiple output series.
 		lowCardOutputIndex[lowCardSeriesID] = make([]uint64, 0, len(outputSeries))
 
 		for i, output := range outputSeries {
-			outputSeries := model.Series{ID: uint64(len(outputIndex)), Metric: output.Metric}
+			metric := output.Metric
+			if len(o.matching.Include) > 0 {
+				metric = includeLabels(metric, lowCardSide[lowCardSeriesID], o.matching.Include)
+			}
+			outputSeries := model.Series{ID: uint64(len(outputIndex)), Metric: metric}
 			outputIndex = append(outputIndex, outputSeries)
 
 			highCardSeriesID := highCardInputIndex[hash][i]
@@ -217,7 +336,18 @@ func (o *vectorOperator) join(
 		}
 	}
 
-	return outputIndex, highCardOutputIndex, lowCardOutputIndex
+	return outputIndex, highCardOutputIndex, lowCardOutputIndex, nil
+}
+
+// includeLabels copies the labels listed in include from lowCard onto metric,
+// overwriting any label already present under the same name. This implements
+// the label propagation side of group_left(...)/group_right(...).
+func includeLabels(metric labels.Labels, lowCard labels.Labels, include []string) labels.Labels {
+	lb := labels.NewBuilder(metric)
+	for _, name := range include {
+		lb.Set(name, lowCard.Get(name))
+	}
+	return lb.Labels()
 }
 
 func signature(metric labels.Labels, without bool, grouping []string, keepLabels bool, buf []byte) (uint64, labels.Labels) {
@@ -242,3 +372,148 @@ func signature(metric labels.Labels, without bool, grouping []string, keepLabels
 	key, _ := metric.HashForLabels(buf, grouping...)
 	return key, lb.Labels()
 }
+
+// isSetOperation returns whether op is one of the set operators
+// `and`, `or` or `unless`. Set operators match series instead of
+// joining their samples, so they bypass the arithmetic table entirely.
+func isSetOperation(op parser.ItemType) bool {
+	switch op {
+	case parser.LAND, parser.LOR, parser.LUNLESS:
+		return true
+	default:
+		return false
+	}
+}
+
+// initSetOutputs computes the vector matching signature of every lhs and rhs
+// series and builds the output series set for a set operator.
+// For `and` and `unless`, the output is exactly the lhs series, since both
+// operators only ever emit lhs samples. For `or`, the output is every lhs
+// series plus every rhs series: whether a given rhs series contributes a
+// sample at a given step is decided in execSetOperation, per step, since a
+// signature collision between an lhs and rhs series does not mean the lhs
+// side actually has a sample at every step.
+func (o *vectorOperator) initSetOutputs(ctx context.Context) error {
+	lhsSeries, err := o.lhs.Series(ctx)
+	if err != nil {
+		return err
+	}
+	rhsSeries, err := o.rhs.Series(ctx)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 128)
+	o.lhsSigs = make([]uint64, len(lhsSeries))
+	for i, s := range lhsSeries {
+		sig, _ := signature(s, !o.matching.On, o.matching.MatchingLabels, true, buf)
+		o.lhsSigs[i] = sig
+	}
+
+	o.rhsSigs = make([]uint64, len(rhsSeries))
+	for i, s := range rhsSeries {
+		sig, _ := signature(s, !o.matching.On, o.matching.MatchingLabels, true, buf)
+		o.rhsSigs[i] = sig
+	}
+
+	series := make([]labels.Labels, len(lhsSeries), len(lhsSeries)+len(rhsSeries))
+	copy(series, lhsSeries)
+
+	if o.operation == parser.LOR {
+		o.rhsOutputIndex = make([]uint64, len(rhsSeries))
+		for i, s := range rhsSeries {
+			o.rhsOutputIndex[i] = uint64(len(series))
+			series = append(series, s)
+		}
+	}
+
+	o.series = series
+	o.pool.SetStepSize(len(o.series))
+	return nil
+}
+
+// execSetOperation evaluates a set operator (and/or/unless) for each step,
+// deciding emission per lhs/rhs sample pair based on whether a matching
+// signature is present in the other side at that particular step, rather
+// than executing an arithmetic operation between values. lhs and rhs need
+// not have the same length: for `or`, one side can keep producing steps
+// after the other has been exhausted, and for `unless`, lhs can keep
+// producing steps after rhs has been exhausted.
+func (o *vectorOperator) execSetOperation(lhs, rhs []model.StepVector) []model.StepVector {
+	steps := len(lhs)
+	if len(rhs) > steps {
+		steps = len(rhs)
+	}
+
+	batch := o.pool.GetVectorBatch()
+	for i := 0; i < steps; i++ {
+		var lhsVector, rhsVector model.StepVector
+		haveLhs := i < len(lhs)
+		haveRhs := i < len(rhs)
+		if haveLhs {
+			lhsVector = lhs[i]
+		}
+		if haveRhs {
+			rhsVector = rhs[i]
+		}
+
+		ts := rhsVector.T
+		if haveLhs {
+			ts = lhsVector.T
+		}
+		step := o.pool.GetStepVector(ts)
+
+		rhsSigSet := make(map[uint64]struct{}, len(rhsVector.SampleIDs))
+		for _, id := range rhsVector.SampleIDs {
+			rhsSigSet[o.rhsSigs[id]] = struct{}{}
+		}
+
+		switch o.operation {
+		case parser.LAND:
+			for j, id := range lhsVector.SampleIDs {
+				if _, ok := rhsSigSet[o.lhsSigs[id]]; ok {
+					step.SampleIDs = append(step.SampleIDs, id)
+					step.Samples = append(step.Samples, lhsVector.Samples[j])
+				}
+			}
+		case parser.LUNLESS:
+			for j, id := range lhsVector.SampleIDs {
+				if _, ok := rhsSigSet[o.lhsSigs[id]]; !ok {
+					step.SampleIDs = append(step.SampleIDs, id)
+					step.Samples = append(step.Samples, lhsVector.Samples[j])
+				}
+			}
+		case parser.LOR:
+			lhsSigSet := make(map[uint64]struct{}, len(lhsVector.SampleIDs))
+			for j, id := range lhsVector.SampleIDs {
+				lhsSigSet[o.lhsSigs[id]] = struct{}{}
+				step.SampleIDs = append(step.SampleIDs, id)
+				step.Samples = append(step.Samples, lhsVector.Samples[j])
+			}
+			for j, id := range rhsVector.SampleIDs {
+				if _, ok := lhsSigSet[o.rhsSigs[id]]; ok {
+					continue
+				}
+				step.SampleIDs = append(step.SampleIDs, o.rhsOutputIndex[id])
+				step.Samples = append(step.Samples, rhsVector.Samples[j])
+			}
+		}
+
+		batch = append(batch, step)
+		if haveLhs {
+			o.lhs.GetPool().PutStepVector(lhsVector)
+		}
+		if haveRhs {
+			o.rhs.GetPool().PutStepVector(rhsVector)
+		}
+	}
+
+	if len(lhs) > 0 {
+		o.lhs.GetPool().PutVectors(lhs)
+	}
+	if len(rhs) > 0 {
+		o.rhs.GetPool().PutVectors(rhs)
+	}
+
+	return batch
+}
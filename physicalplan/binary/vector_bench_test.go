@@ -0,0 +1,107 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package binary
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/thanos-community/promql-engine/physicalplan/model"
+)
+
+// delayedSelector simulates a remote read / Thanos StoreAPI selector whose
+// Series() call incurs network latency before returning a single series.
+type delayedSelector struct {
+	pool  *model.VectorPool
+	delay time.Duration
+	done  bool
+}
+
+func (d *delayedSelector) Series(ctx context.Context) ([]labels.Labels, error) {
+	select {
+	case <-time.After(d.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return []labels.Labels{labels.FromStrings("__name__", "metric")}, nil
+}
+
+func (d *delayedSelector) Next(ctx context.Context) ([]model.StepVector, error) {
+	if d.done {
+		return nil, nil
+	}
+	d.done = true
+
+	step := d.pool.GetStepVector(0)
+	step.SampleIDs = append(step.SampleIDs, 0)
+	step.Samples = append(step.Samples, 1)
+	return []model.StepVector{step}, nil
+}
+
+func (d *delayedSelector) GetPool() *model.VectorPool {
+	return d.pool
+}
+
+func (d *delayedSelector) Close(ctx context.Context) error {
+	return nil
+}
+
+// buildFanout builds a balanced binary tree of n delayed leaf selectors,
+// merged pairwise with ADD vectorOperators, simulating a deep expression
+// tree sitting on top of many remote read/StoreAPI selectors.
+func buildFanout(pool *model.VectorPool, n int, delay time.Duration) model.VectorOperator {
+	leaves := make([]model.VectorOperator, n)
+	for i := range leaves {
+		leaves[i] = &delayedSelector{pool: pool, delay: delay}
+	}
+
+	for len(leaves) > 1 {
+		next := make([]model.VectorOperator, 0, (len(leaves)+1)/2)
+		for i := 0; i < len(leaves); i += 2 {
+			if i+1 == len(leaves) {
+				next = append(next, leaves[i])
+				continue
+			}
+			op, err := NewVectorOperator(pool, leaves[i], leaves[i+1], &parser.VectorMatching{}, parser.ADD, false)
+			if err != nil {
+				panic(err)
+			}
+			next = append(next, op)
+		}
+		leaves = next
+	}
+
+	return leaves[0]
+}
+
+// BenchmarkVectorOperator_ParallelSeries demonstrates that a deep tree of
+// binary operators over many delayed selectors discovers series in roughly
+// the delay of a single selector, not the sum of all leaves' delays, since
+// each level's lhs/rhs Series() calls run concurrently and so every leaf
+// waits at the same time.
+func BenchmarkVectorOperator_ParallelSeries(b *testing.B) {
+	const (
+		delay  = 5 * time.Millisecond
+		fanout = 16
+	)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pool := model.NewVectorPool(1)
+		lhs := buildFanout(pool, fanout, delay)
+		rhs := buildFanout(pool, fanout, delay)
+
+		op, err := NewVectorOperator(pool, lhs, rhs, &parser.VectorMatching{}, parser.ADD, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := op.Series(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package binary
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/thanos-community/promql-engine/physicalplan/model"
+)
+
+// TestNewVectorOperator_ReturnBool verifies that the `bool` modifier is
+// threaded through NewVectorOperator into the operator, which passes it on
+// to newTable when the table is built. Exercising the actual filter-vs-bool comparison semantics requires
+// the table type, which lives outside this chunk and isn't available here.
+func TestNewVectorOperator_ReturnBool(t *testing.T) {
+	pool := model.NewVectorPool(1)
+	lhs := &fakeOperator{pool: pool}
+	rhs := &fakeOperator{pool: pool}
+	matching := &parser.VectorMatching{}
+
+	op, err := NewVectorOperator(pool, lhs, rhs, matching, parser.EQLC, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, ok := op.(*vectorOperator)
+	if !ok {
+		t.Fatalf("expected *vectorOperator, got %T", op)
+	}
+	if !v.returnBool {
+		t.Fatal("expected returnBool to be threaded through from NewVectorOperator")
+	}
+}
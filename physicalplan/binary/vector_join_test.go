@@ -0,0 +1,114 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package binary
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/thanos-community/promql-engine/physicalplan/model"
+)
+
+// TestVectorOperator_Join_GroupLeftIncludesLowCardLabels verifies that
+// group_left(...) copies the requested labels from the matching low
+// cardinality (rhs) series onto each output series.
+func TestVectorOperator_Join_GroupLeftIncludesLowCardLabels(t *testing.T) {
+	pool := model.NewVectorPool(1)
+	lhs := &fakeOperator{
+		pool: pool,
+		series: []labels.Labels{
+			labels.FromStrings("__name__", "requests", "job", "a"),
+			labels.FromStrings("__name__", "requests", "job", "b"),
+		},
+	}
+	rhs := &fakeOperator{
+		pool: pool,
+		series: []labels.Labels{
+			labels.FromStrings("__name__", "up", "job", "a", "az", "us1"),
+			labels.FromStrings("__name__", "up", "job", "b", "az", "us2"),
+		},
+	}
+
+	matching := &parser.VectorMatching{
+		Card:           parser.CardManyToOne,
+		On:             true,
+		MatchingLabels: []string{"job"},
+		Include:        []string{"az"},
+	}
+	op, err := NewVectorOperator(pool, lhs, rhs, matching, parser.ADD, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	series, err := op.Series(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]string, len(series))
+	for _, s := range series {
+		got[s.Get("job")] = s.Get("az")
+	}
+	if got["a"] != "us1" || got["b"] != "us2" {
+		t.Fatalf("expected group_left to propagate az from the matching rhs series, got %v", got)
+	}
+}
+
+// TestVectorOperator_Join_AmbiguousMatches verifies that a high cardinality
+// series matching more than one low cardinality series is rejected, with the
+// message matching which case caused the ambiguity.
+func TestVectorOperator_Join_AmbiguousMatches(t *testing.T) {
+	newLhs := func() *fakeOperator {
+		return &fakeOperator{
+			pool:   model.NewVectorPool(1),
+			series: []labels.Labels{labels.FromStrings("__name__", "requests", "job", "a")},
+		}
+	}
+	newRhs := func() *fakeOperator {
+		return &fakeOperator{
+			pool: model.NewVectorPool(1),
+			series: []labels.Labels{
+				labels.FromStrings("__name__", "up", "job", "a", "az", "us1"),
+				labels.FromStrings("__name__", "up", "job", "a", "az", "us2"),
+			},
+		}
+	}
+
+	t.Run("one-to-one", func(t *testing.T) {
+		pool := model.NewVectorPool(1)
+		matching := &parser.VectorMatching{Card: parser.CardOneToOne, On: true, MatchingLabels: []string{"job"}}
+		op, err := NewVectorOperator(pool, newLhs(), newRhs(), matching, parser.ADD, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = op.Series(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "many-to-one matching must be explicit") {
+			t.Fatalf("expected a many-to-one hint error, got %v", err)
+		}
+	})
+
+	t.Run("many-to-one", func(t *testing.T) {
+		pool := model.NewVectorPool(1)
+		matching := &parser.VectorMatching{
+			Card:           parser.CardManyToOne,
+			On:             true,
+			MatchingLabels: []string{"job"},
+			Include:        []string{"az"},
+		}
+		op, err := NewVectorOperator(pool, newLhs(), newRhs(), matching, parser.ADD, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = op.Series(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "grouping labels must ensure unique matches") {
+			t.Fatalf("expected a grouping-labels ambiguity error, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,201 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package binary
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/thanos-community/promql-engine/physicalplan/model"
+)
+
+// fakeOperator is a minimal model.VectorOperator backed by a fixed series
+// list and a queue of step batches, used to drive vectorOperator in
+// isolation from real selectors.
+type fakeOperator struct {
+	pool   *model.VectorPool
+	series []labels.Labels
+	steps  [][]model.StepVector
+	idx    int
+}
+
+func (f *fakeOperator) Series(context.Context) ([]labels.Labels, error) {
+	return f.series, nil
+}
+
+func (f *fakeOperator) Next(context.Context) ([]model.StepVector, error) {
+	if f.idx >= len(f.steps) {
+		return nil, nil
+	}
+	batch := f.steps[f.idx]
+	f.idx++
+	return batch, nil
+}
+
+func (f *fakeOperator) GetPool() *model.VectorPool { return f.pool }
+
+func (f *fakeOperator) Close(context.Context) error { return nil }
+
+func testSeries(value string) labels.Labels {
+	return labels.FromStrings("__name__", "m", "l", value)
+}
+
+func assertStep(t *testing.T, step model.StepVector, ids []uint64, vals []float64) {
+	t.Helper()
+	if !reflect.DeepEqual(step.SampleIDs, ids) {
+		t.Fatalf("expected sample IDs %v, got %v", ids, step.SampleIDs)
+	}
+	if !reflect.DeepEqual(step.Samples, vals) {
+		t.Fatalf("expected samples %v, got %v", vals, step.Samples)
+	}
+}
+
+// TestVectorOperator_SetOperations covers `and`/`or`/`unless` emission. lhs
+// has two series (a, b); rhs only has a series matching "a". At step 1, lhs
+// drops its sample for "a" (but the series itself still exists), which must
+// flip what `or` emits for the colliding rhs sample.
+func TestVectorOperator_SetOperations(t *testing.T) {
+	pool := model.NewVectorPool(1)
+
+	newLhs := func() *fakeOperator {
+		return &fakeOperator{
+			pool:   pool,
+			series: []labels.Labels{testSeries("a"), testSeries("b")},
+			steps: [][]model.StepVector{
+				{{T: 0, SampleIDs: []uint64{0, 1}, Samples: []float64{1, 2}}},
+				{{T: 1, SampleIDs: []uint64{1}, Samples: []float64{20}}},
+			},
+		}
+	}
+	newRhs := func() *fakeOperator {
+		return &fakeOperator{
+			pool:   pool,
+			series: []labels.Labels{testSeries("a")},
+			steps: [][]model.StepVector{
+				{{T: 0, SampleIDs: []uint64{0}, Samples: []float64{100}}},
+				{{T: 1, SampleIDs: []uint64{0}, Samples: []float64{200}}},
+			},
+		}
+	}
+	matching := &parser.VectorMatching{Card: parser.CardManyToMany}
+
+	t.Run("and", func(t *testing.T) {
+		op, err := NewVectorOperator(pool, newLhs(), newRhs(), matching, parser.LAND, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		step0, err := op.Next(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertStep(t, step0[0], []uint64{0}, []float64{1})
+
+		step1, err := op.Next(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(step1[0].SampleIDs) != 0 {
+			t.Fatalf("expected no matches at step 1, got %v", step1[0].SampleIDs)
+		}
+	})
+
+	t.Run("unless", func(t *testing.T) {
+		op, err := NewVectorOperator(pool, newLhs(), newRhs(), matching, parser.LUNLESS, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		step0, err := op.Next(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertStep(t, step0[0], []uint64{1}, []float64{2})
+
+		step1, err := op.Next(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertStep(t, step1[0], []uint64{1}, []float64{20})
+	})
+
+	t.Run("or decides rhs inclusion per step, not from global series overlap", func(t *testing.T) {
+		op, err := NewVectorOperator(pool, newLhs(), newRhs(), matching, parser.LOR, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		step0, err := op.Next(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// rhs series "a" matches lhs series "a" at step 0 and must be suppressed.
+		assertStep(t, step0[0], []uint64{0, 1}, []float64{1, 2})
+
+		step1, err := op.Next(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// lhs has no sample for "a" at step 1, so the matching rhs sample must
+		// be emitted even though the two series collide globally. Its output
+		// ID comes after the two lhs series (0, 1).
+		assertStep(t, step1[0], []uint64{1, 2}, []float64{20, 200})
+	})
+}
+
+// TestVectorOperator_SetOperation_OrDrainsPastExhaustion verifies that `or`
+// keeps emitting rhs samples after lhs is exhausted, instead of dropping them.
+func TestVectorOperator_SetOperation_OrDrainsPastExhaustion(t *testing.T) {
+	pool := model.NewVectorPool(1)
+
+	lhs := &fakeOperator{
+		pool:   pool,
+		series: []labels.Labels{testSeries("a")},
+		steps: [][]model.StepVector{
+			{{T: 0, SampleIDs: []uint64{0}, Samples: []float64{1}}},
+		},
+	}
+	rhs := &fakeOperator{
+		pool:   pool,
+		series: []labels.Labels{testSeries("b")},
+		steps: [][]model.StepVector{
+			{{T: 0, SampleIDs: []uint64{0}, Samples: []float64{100}}},
+			{{T: 1, SampleIDs: []uint64{0}, Samples: []float64{200}}},
+		},
+	}
+
+	op, err := NewVectorOperator(pool, lhs, rhs, &parser.VectorMatching{Card: parser.CardManyToMany}, parser.LOR, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	step0, err := op.Next(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStep(t, step0[0], []uint64{0, 1}, []float64{1, 100})
+
+	// lhs is now exhausted, but rhs still has a step left: it must be emitted,
+	// not silently dropped.
+	step1, err := op.Next(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(step1) != 1 {
+		t.Fatalf("expected rhs-only batch after lhs exhaustion, got %v", step1)
+	}
+	assertStep(t, step1[0], []uint64{1}, []float64{200})
+
+	step2, err := op.Next(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if step2 != nil {
+		t.Fatalf("expected nil once both sides are exhausted, got %v", step2)
+	}
+}
@@ -53,6 +53,14 @@ func (o *numberLiteralSelector) GetPool() *model.VectorPool {
 	return o.vectorPool
 }
 
+// Close is a no-op since a number literal selector holds no upstream
+// resources (storage iterators, goroutines, ...) to release.
+func (o *numberLiteralSelector) Close(ctx context.Context) error {
+	return nil
+}
+
+// Next always produces float-valued samples: every step vector it returns
+// holds a single sample, with ID 0, in SampleIDs and Samples.
 func (o *numberLiteralSelector) Next(ctx context.Context) ([]model.StepVector, error) {
 	if o.currentStep > o.maxt {
 		return nil, nil